@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/richardwilkes/toolbox/v2/errs"
+	"github.com/richardwilkes/toolbox/v2/xio"
+)
+
+// cacheMagic identifies a hash cache file.
+var cacheMagic = [4]byte{'F', 'D', 'U', 'P'}
+
+// cacheVersion is the current on-disk record layout. Bumping it lets a future version of fdup refuse to interpret a
+// cache file written by an incompatible version, rather than silently misreading it.
+const cacheVersion = 1
+
+// cacheAlgoSHA256 identifies the hash algorithm stored in a cache record. It is written into the file header so a
+// future algorithm (e.g. BLAKE3) can be added without breaking compatibility with caches written by older versions.
+const cacheAlgoSHA256 = 0
+
+// recordSize is the on-disk size, in bytes, of a single cacheRecord: dev, ino, size and mtimeNs (8 bytes each),
+// followed by a 32-byte sum.
+const recordSize = 8*4 + 32
+
+// cacheKey identifies a file for caching purposes. Keying on device and inode, rather than path, means a file that
+// was moved but not modified is still a cache hit.
+type cacheKey struct {
+	dev     uint64
+	ino     uint64
+	size    int64
+	mtimeNs int64
+}
+
+// hashCache is an on-disk, append-only log of previously computed file hashes, keyed by cacheKey. It lets repeat runs
+// over the same tree skip re-reading files that haven't changed.
+type hashCache struct {
+	path    string
+	lock    sync.Mutex
+	entries map[cacheKey][32]byte
+	file    *os.File
+}
+
+// defaultCachePath returns the default location for the hash cache, `~/.cache/fdup/hashes.db`.
+func defaultCachePath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+	return filepath.Join(home, ".cache", "fdup", "hashes.db")
+}
+
+// openCache loads the hash cache at path, creating it and any missing parent directories if it doesn't yet exist. If
+// rehash is true, any existing entries are discarded, but the file is still kept open so new entries can be written.
+func openCache(path string, rehash bool) (*hashCache, error) {
+	c := &hashCache{path: path, entries: make(map[cacheKey][32]byte)}
+	if !rehash {
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, errs.Wrap(err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	c.file = f
+	if err = c.writeHeaderIfEmpty(); err != nil {
+		xio.CloseIgnoringErrors(f)
+		return nil, err
+	}
+	if _, err = f.Seek(0, io.SeekEnd); err != nil {
+		xio.CloseIgnoringErrors(f)
+		return nil, errs.Wrap(err)
+	}
+	return c, nil
+}
+
+// writeHeaderIfEmpty writes the cache file header if the file is newly created (i.e. empty).
+func (c *hashCache) writeHeaderIfEmpty() error {
+	info, err := c.file.Stat()
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	if info.Size() > 0 {
+		return nil
+	}
+	if _, err = c.file.Write(cacheMagic[:]); err != nil {
+		return errs.Wrap(err)
+	}
+	if _, err = c.file.Write([]byte{cacheVersion, cacheAlgoSHA256}); err != nil {
+		return errs.Wrap(err)
+	}
+	return nil
+}
+
+// load reads every record currently in the cache file into memory. A cache written by an incompatible version or
+// using an unsupported algorithm is treated as empty rather than an error, so fdup can still run with a cold cache.
+func (c *hashCache) load() error {
+	f, err := os.Open(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errs.Wrap(err)
+	}
+	defer xio.CloseIgnoringErrors(f)
+
+	r := bufio.NewReader(f)
+	var header [6]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		return errs.Wrap(err)
+	}
+	if header[0] != cacheMagic[0] || header[1] != cacheMagic[1] || header[2] != cacheMagic[2] ||
+		header[3] != cacheMagic[3] || header[4] != cacheVersion || header[5] != cacheAlgoSHA256 {
+		return nil
+	}
+
+	buf := make([]byte, recordSize)
+	for {
+		if _, err = io.ReadFull(r, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return errs.Wrap(err)
+		}
+		key := cacheKey{
+			dev:     binary.BigEndian.Uint64(buf[0:8]),
+			ino:     binary.BigEndian.Uint64(buf[8:16]),
+			size:    int64(binary.BigEndian.Uint64(buf[16:24])),
+			mtimeNs: int64(binary.BigEndian.Uint64(buf[24:32])),
+		}
+		var sum [32]byte
+		copy(sum[:], buf[32:64])
+		c.entries[key] = sum
+	}
+}
+
+// lookup returns the cached hash for key, if one is known.
+func (c *hashCache) lookup(key cacheKey) ([32]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	sum, ok := c.entries[key]
+	return sum, ok
+}
+
+// store records sum as the hash for key, both in memory and appended to the on-disk log. An append-only log lets
+// concurrent writers avoid coordinating over the whole file; periodic compaction keeps it from growing unbounded.
+func (c *hashCache) store(key cacheKey, sum [32]byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, exists := c.entries[key]; !exists || c.entries[key] != sum {
+		buf := make([]byte, recordSize)
+		binary.BigEndian.PutUint64(buf[0:8], key.dev)
+		binary.BigEndian.PutUint64(buf[8:16], key.ino)
+		binary.BigEndian.PutUint64(buf[16:24], uint64(key.size))
+		binary.BigEndian.PutUint64(buf[24:32], uint64(key.mtimeNs))
+		copy(buf[32:64], sum[:])
+		if _, err := c.file.Write(buf); err == nil {
+			c.entries[key] = sum
+		}
+	}
+}
+
+// compactionThreshold is how many times the number of unique entries the log is allowed to grow to before it gets
+// rewritten with just the current, deduplicated set of records.
+const compactionThreshold = 4
+
+// close compacts the cache file if it has accumulated enough stale records, then closes it.
+func (c *hashCache) close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if info, err := c.file.Stat(); err == nil {
+		if live := int64(len(c.entries)) * recordSize; live > 0 && info.Size() > 6+live*compactionThreshold {
+			if err = c.compactLocked(); err != nil {
+				xio.CloseIgnoringErrors(c.file)
+				return err
+			}
+		}
+	}
+	return c.file.Close()
+}
+
+// compactLocked rewrites the cache file to contain only the current in-memory entries. The caller must hold c.lock.
+func (c *hashCache) compactLocked() error {
+	tmpPath := c.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	if _, err = tmp.Write(cacheMagic[:]); err == nil {
+		_, err = tmp.Write([]byte{cacheVersion, cacheAlgoSHA256})
+	}
+	buf := make([]byte, recordSize)
+	for key, sum := range c.entries {
+		if err != nil {
+			break
+		}
+		binary.BigEndian.PutUint64(buf[0:8], key.dev)
+		binary.BigEndian.PutUint64(buf[8:16], key.ino)
+		binary.BigEndian.PutUint64(buf[16:24], uint64(key.size))
+		binary.BigEndian.PutUint64(buf[24:32], uint64(key.mtimeNs))
+		copy(buf[32:64], sum[:])
+		_, err = tmp.Write(buf)
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		xio.CloseIgnoringErrors(tmp)
+	}
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	if err = os.Rename(tmpPath, c.path); err != nil {
+		return errs.Wrap(err)
+	}
+	if c.file, err = os.OpenFile(c.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644); err != nil {
+		return errs.Wrap(err)
+	}
+	return nil
+}
+
+// cacheKeyFor builds a cacheKey for path using info, if the platform exposes the device and inode numbers needed to
+// do so.
+func cacheKeyFor(info os.FileInfo) (cacheKey, bool) {
+	dev, ino, ok := statIdentity(info)
+	if !ok {
+		return cacheKey{}, false
+	}
+	return cacheKey{dev: dev, ino: ino, size: info.Size(), mtimeNs: info.ModTime().UnixNano()}, true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/richardwilkes/toolbox/v2/check"
+)
+
+func TestHashCacheRoundTrip(t *testing.T) {
+	c := check.New(t)
+	path := filepath.Join(t.TempDir(), "hashes.db")
+
+	cache, err := openCache(path, false)
+	c.NoError(err)
+	keyA := cacheKey{dev: 1, ino: 2, size: 3, mtimeNs: 4}
+	keyB := cacheKey{dev: 5, ino: 6, size: 7, mtimeNs: 8}
+	sumA := [32]byte{1}
+	sumB := [32]byte{2}
+	cache.store(keyA, sumA)
+	cache.store(keyB, sumB)
+	c.NoError(cache.close())
+
+	reopened, err := openCache(path, false)
+	c.NoError(err)
+	defer func() { c.NoError(reopened.close()) }()
+
+	gotA, ok := reopened.lookup(keyA)
+	c.True(ok)
+	c.Equal(sumA, gotA)
+
+	gotB, ok := reopened.lookup(keyB)
+	c.True(ok)
+	c.Equal(sumB, gotB)
+
+	_, ok = reopened.lookup(cacheKey{dev: 99})
+	c.False(ok)
+}
+
+func TestHashCacheRehashDiscardsExistingEntries(t *testing.T) {
+	c := check.New(t)
+	path := filepath.Join(t.TempDir(), "hashes.db")
+
+	cache, err := openCache(path, false)
+	c.NoError(err)
+	key := cacheKey{dev: 1, ino: 1, size: 1, mtimeNs: 1}
+	cache.store(key, [32]byte{1})
+	c.NoError(cache.close())
+
+	reopened, err := openCache(path, true)
+	c.NoError(err)
+	defer func() { c.NoError(reopened.close()) }()
+
+	_, ok := reopened.lookup(key)
+	c.False(ok)
+}
+
+func TestHashCacheCompactsOnClose(t *testing.T) {
+	c := check.New(t)
+	path := filepath.Join(t.TempDir(), "hashes.db")
+
+	cache, err := openCache(path, false)
+	c.NoError(err)
+	key := cacheKey{dev: 1, ino: 1, size: 1, mtimeNs: 1}
+	var last [32]byte
+	// Store more distinct sums for the same key than compactionThreshold allows, to push the log past the point
+	// where close() rewrites it down to just the current entries.
+	for i := range compactionThreshold + 2 {
+		sum := [32]byte{byte(i + 1)}
+		cache.store(key, sum)
+		last = sum
+	}
+	c.NoError(cache.close())
+
+	info, err := os.Stat(path)
+	c.NoError(err)
+	c.Equal(int64(6+recordSize), info.Size())
+
+	reopened, err := openCache(path, false)
+	c.NoError(err)
+	defer func() { c.NoError(reopened.close()) }()
+	got, ok := reopened.lookup(key)
+	c.True(ok)
+	c.Equal(last, got)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// dirNode is a directory that has been walked and digested. The header digest covers only the direct children's
+// names, modes and sizes, while the content digest folds in each child's content digest as well, so two directories
+// only share a content digest if their entire subtrees are identical.
+type dirNode struct {
+	path    string
+	size    int64
+	content [32]byte
+}
+
+// dirsByContent collects every directory digested so far, keyed by content digest, for -dirs mode.
+var dirsByContent = make(map[[32]byte][]*dirNode)
+
+// digestDirTree digests root and everything beneath it, recording each directory found in dirsByContent.
+func digestDirTree(root string) error {
+	node, err := digestDir(root, dirsByContent)
+	if err != nil {
+		return err
+	}
+	dirsByContent[node.content] = append(dirsByContent[node.content], node)
+	return nil
+}
+
+// dirGroup is a set of two or more directories confirmed to have identical content, along with the digest they
+// share.
+type dirGroup struct {
+	hash  [32]byte
+	nodes []*dirNode
+}
+
+// reportDirs sends the duplicate directory subtrees found by digestDirTree to r, largest first, suppressing any
+// nested match whose parent was already reported.
+func reportDirs(r Reporter) {
+	var groups []*dirGroup
+	for hash, nodes := range dirsByContent {
+		if len(nodes) > 1 {
+			groups = append(groups, &dirGroup{hash: hash, nodes: nodes})
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		di, dj := depth(groups[i].nodes[0].path), depth(groups[j].nodes[0].path)
+		if di != dj {
+			return di < dj
+		}
+		return groups[i].nodes[0].size > groups[j].nodes[0].size
+	})
+
+	var reported []string
+	for _, group := range groups {
+		survivors := unreportedNodes(group.nodes, reported)
+		if len(survivors) < 2 {
+			continue
+		}
+		paths := make([]string, len(survivors))
+		for i, node := range survivors {
+			paths[i] = node.path
+			reported = append(reported, node.path)
+		}
+		atomic.AddInt32(&duplicatesFound, int32(len(survivors)-1))
+		atomic.AddInt64(&duplicateBytes, survivors[0].size*int64(len(survivors)-1))
+		hash := group.hash
+		r.Group(paths, survivors[0].size, &hash)
+	}
+}
+
+// depth returns the number of path separators in path, used to order duplicate directory groups from shallowest
+// (largest) to deepest so parents are reported before any of their own subdirectories.
+func depth(path string) int {
+	return strings.Count(filepath.Clean(path), string(filepath.Separator))
+}
+
+// unreportedNodes returns the members of group that are not nested inside (or equal to) a directory already in
+// reported, dropping only those specific members rather than discarding the whole group. A sibling pair that happens
+// to share a group with an already-reported match is still a genuine, independent duplicate and must survive.
+func unreportedNodes(group []*dirNode, reported []string) []*dirNode {
+	var survivors []*dirNode
+	for _, node := range group {
+		if !isUnderReported(node.path, reported) {
+			survivors = append(survivors, node)
+		}
+	}
+	return survivors
+}
+
+// isUnderReported returns true if path is, or is nested inside, a directory already in reported.
+func isUnderReported(path string, reported []string) bool {
+	for _, prefix := range reported {
+		if path == prefix || strings.HasPrefix(path, prefix+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// digestDir computes the content digest for path and every directory beneath it, honoring the -hidden, -ext and
+// -case flags the same way the duplicate-file walk does. Symlinks are hashed by their target string rather than
+// followed. Every directory visited, including path itself, is recorded in byContent so duplicate subtrees at any
+// depth can be found.
+func digestDir(path string, byContent map[[32]byte][]*dirNode) (*dirNode, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	h := sha256.New()
+	var size int64
+	var childDigests [][32]byte
+	for _, entry := range entries {
+		name := entry.Name()
+		if !hidden && strings.HasPrefix(name, ".") {
+			continue
+		}
+		if !entry.IsDir() && !isFileNameAcceptable(name) {
+			continue
+		}
+		childPath := filepath.Join(path, name)
+		info, err := entry.Info()
+		if err != nil {
+			atomic.AddInt32(&filesUnableToProcess, 1)
+			continue
+		}
+
+		var childDigest [32]byte
+		var childSize int64
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(childPath)
+			if err != nil {
+				atomic.AddInt32(&filesUnableToProcess, 1)
+				continue
+			}
+			childDigest = sha256.Sum256([]byte(target))
+		case entry.IsDir():
+			child, err := digestDir(childPath, byContent)
+			if err != nil {
+				atomic.AddInt32(&filesUnableToProcess, 1)
+				continue
+			}
+			byContent[child.content] = append(byContent[child.content], child)
+			childDigest = child.content
+			childSize = child.size
+		default:
+			sum, n, err := hashFileCached(childPath)
+			if err != nil {
+				atomic.AddInt32(&filesUnableToProcess, 1)
+				continue
+			}
+			atomic.AddInt32(&filesProcessed, 1)
+			atomic.AddInt64(&bytesProcessed, n)
+			childDigest = sum
+			childSize = n
+		}
+
+		writeHeaderEntry(h, name, info.Mode(), info.Size())
+		childDigests = append(childDigests, childDigest)
+		size += childSize
+	}
+
+	var header [32]byte
+	copy(header[:], h.Sum(nil))
+
+	contentHash := sha256.New()
+	contentHash.Write(header[:])
+	for _, digest := range childDigests {
+		contentHash.Write(digest[:])
+	}
+	var content [32]byte
+	copy(content[:], contentHash.Sum(nil))
+
+	return &dirNode{path: path, size: size, content: content}, nil
+}
+
+// writeHeaderEntry writes a single child's (name, mode, size) tuple into the running header digest. There is
+// currently no portable way to summarize extended attributes, so that slot is left empty pending a follow-up.
+func writeHeaderEntry(h hash.Hash, name string, mode os.FileMode, size int64) {
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00\x00", name, mode, size)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/richardwilkes/toolbox/v2/check"
+)
+
+// recordingReporter captures the groups it's handed, for asserting on reportDirs' output without a real Reporter.
+type recordingReporter struct {
+	groups [][]string
+}
+
+func (r *recordingReporter) Progress() {}
+
+func (r *recordingReporter) Group(paths []string, _ int64, _ *[32]byte) {
+	r.groups = append(r.groups, append([]string(nil), paths...))
+}
+
+func (r *recordingReporter) Removed(string) {}
+
+func (r *recordingReporter) Linked(string) {}
+
+func (r *recordingReporter) UnableToDedup(string) {}
+
+func (r *recordingReporter) Finish() {}
+
+func TestDigestDirMatchesIdenticalSubtrees(t *testing.T) {
+	c := check.New(t)
+	root := t.TempDir()
+	a := filepath.Join(root, "a")
+	b := filepath.Join(root, "b")
+	for _, dir := range []string{a, b} {
+		c.NoError(os.MkdirAll(dir, 0o755))
+		c.NoError(os.WriteFile(filepath.Join(dir, "f.txt"), []byte("same"), 0o644))
+	}
+
+	nodeA, err := digestDir(a, make(map[[32]byte][]*dirNode))
+	c.NoError(err)
+	nodeB, err := digestDir(b, make(map[[32]byte][]*dirNode))
+	c.NoError(err)
+	c.Equal(nodeA.content, nodeB.content)
+}
+
+func TestDigestDirHonorsExtensionFilter(t *testing.T) {
+	c := check.New(t)
+	origExt, origCase := extensions, caseSensitive
+	defer func() { extensions, caseSensitive = origExt, origCase }()
+
+	root := t.TempDir()
+	a := filepath.Join(root, "a")
+	b := filepath.Join(root, "b")
+	for _, dir := range []string{a, b} {
+		c.NoError(os.MkdirAll(dir, 0o755))
+		c.NoError(os.WriteFile(filepath.Join(dir, "same.jpg"), []byte("same"), 0o644))
+	}
+	c.NoError(os.WriteFile(filepath.Join(a, "only-in-a.txt"), []byte("a-only"), 0o644))
+
+	extensions = nil
+	nodeA, err := digestDir(a, make(map[[32]byte][]*dirNode))
+	c.NoError(err)
+	nodeB, err := digestDir(b, make(map[[32]byte][]*dirNode))
+	c.NoError(err)
+	c.NotEqual(nodeA.content, nodeB.content)
+
+	extensions = []string{".jpg"}
+	nodeA, err = digestDir(a, make(map[[32]byte][]*dirNode))
+	c.NoError(err)
+	nodeB, err = digestDir(b, make(map[[32]byte][]*dirNode))
+	c.NoError(err)
+	c.Equal(nodeA.content, nodeB.content)
+}
+
+// TestReportDirsKeepsIndependentSiblingAfterLargerMatchReported guards against reportDirs discarding a whole content
+// group just because one of its members happens to be nested under a directory that a larger, unrelated match
+// already reported. Only the nested member should be dropped; the remaining, independent duplicate pair must still
+// be reported.
+func TestReportDirsKeepsIndependentSiblingAfterLargerMatchReported(t *testing.T) {
+	c := check.New(t)
+	orig := dirsByContent
+	defer func() { dirsByContent = orig }()
+
+	parentHash := sha256.Sum256([]byte("parent"))
+	siblingHash := sha256.Sum256([]byte("sibling"))
+	dirsByContent = map[[32]byte][]*dirNode{
+		parentHash: {
+			{path: "/reportedParent", size: 100},
+			{path: "/otherParent", size: 100},
+		},
+		siblingHash: {
+			{path: "/reportedParent/sub/foo", size: 5},
+			{path: "/unrelated/location/foo", size: 5},
+			{path: "/another/place/foo", size: 5},
+		},
+	}
+
+	r := &recordingReporter{}
+	reportDirs(r)
+
+	c.Equal(2, len(r.groups))
+	c.Equal([]string{"/reportedParent", "/otherParent"}, r.groups[0])
+	c.Equal([]string{"/unrelated/location/foo", "/another/place/foo"}, r.groups[1])
+}
+
+// TestReportDirsUpdatesDuplicateCounters guards against the -dirs summary silently reporting zero duplicates: the
+// same duplicatesFound/duplicateBytes counters recordGroup updates for -format=text/json must also be updated here,
+// since reportDirs is the only thing that knows about directory matches.
+func TestReportDirsUpdatesDuplicateCounters(t *testing.T) {
+	c := check.New(t)
+	orig := dirsByContent
+	defer func() { dirsByContent = orig }()
+	origFound, origBytes := atomic.LoadInt32(&duplicatesFound), atomic.LoadInt64(&duplicateBytes)
+	defer func() {
+		atomic.StoreInt32(&duplicatesFound, origFound)
+		atomic.StoreInt64(&duplicateBytes, origBytes)
+	}()
+	atomic.StoreInt32(&duplicatesFound, 0)
+	atomic.StoreInt64(&duplicateBytes, 0)
+
+	hash := sha256.Sum256([]byte("match"))
+	dirsByContent = map[[32]byte][]*dirNode{
+		hash: {
+			{path: "/a", size: 10},
+			{path: "/b", size: 10},
+			{path: "/c", size: 10},
+		},
+	}
+
+	reportDirs(&recordingReporter{})
+
+	c.Equal(int32(2), atomic.LoadInt32(&duplicatesFound))
+	c.Equal(int64(20), atomic.LoadInt64(&duplicateBytes))
+}
@@ -0,0 +1,50 @@
+// Package linker replaces a duplicate file with a link to the file it duplicates, reclaiming disk space while
+// leaving the apparent directory layout untouched.
+package linker
+
+import (
+	"os"
+
+	"github.com/richardwilkes/toolbox/v2/errs"
+)
+
+// Mode selects how a duplicate is replaced.
+type Mode string
+
+// The supported link modes.
+const (
+	// Hard replaces the duplicate with a hard link to the retained file. Both files must reside on the same
+	// filesystem.
+	Hard Mode = "hard"
+	// Reflink replaces the duplicate with a copy-on-write clone of the retained file, if the filesystem supports it.
+	Reflink Mode = "reflink"
+)
+
+// Replace replaces dup with a link to keep using the given mode. The caller is responsible for having already
+// confirmed that keep and dup have identical contents.
+func Replace(mode Mode, keep, dup string) error {
+	switch mode {
+	case Hard:
+		return hardLink(keep, dup)
+	case Reflink:
+		return reflink(keep, dup)
+	default:
+		return errs.Newf("linker: unknown mode %q", mode)
+	}
+}
+
+// replaceAtomically builds the replacement for dup at a temporary path beside it via create, then renames it over
+// dup. This keeps a failed link attempt from leaving dup missing.
+func replaceAtomically(dup string, create func(tmp string) error) error {
+	tmp := dup + ".fdup-tmp"
+	_ = os.Remove(tmp)
+	if err := create(tmp); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dup); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
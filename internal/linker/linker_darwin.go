@@ -0,0 +1,54 @@
+//go:build darwin
+
+package linker
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/richardwilkes/toolbox/v2/errs"
+	"golang.org/x/sys/unix"
+)
+
+// hardLink replaces dup with a hard link to keep, after confirming both files live on the same filesystem.
+func hardLink(keep, dup string) error {
+	sameDevice, err := onSameDevice(keep, dup)
+	if err != nil {
+		return err
+	}
+	if !sameDevice {
+		return errs.Newf("linker: %s and %s are not on the same filesystem", keep, dup)
+	}
+	return replaceAtomically(dup, func(tmp string) error { return os.Link(keep, tmp) })
+}
+
+// reflink replaces dup with a copy-on-write clone of keep, using clonefile(2).
+func reflink(keep, dup string) error {
+	return replaceAtomically(dup, func(tmp string) error {
+		if err := unix.Clonefile(keep, tmp, 0); err != nil {
+			return errs.NewWithCausef(err, "linker: filesystem does not support reflinks")
+		}
+		return nil
+	})
+}
+
+// onSameDevice reports whether a and b reside on the same filesystem.
+func onSameDevice(a, b string) (bool, error) {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false, errs.Wrap(err)
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false, errs.Wrap(err)
+	}
+	aSt, ok := aInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, errs.Newf("linker: unable to determine device for %s", a)
+	}
+	bSt, ok := bInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, errs.Newf("linker: unable to determine device for %s", b)
+	}
+	return aSt.Dev == bSt.Dev, nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin
+
+package linker
+
+import (
+	"os"
+
+	"github.com/richardwilkes/toolbox/v2/errs"
+)
+
+// hardLink replaces dup with a hard link to keep. There's no portable way to confirm both files share a device
+// ahead of time on this platform, so this simply attempts the link and reports whatever error the OS returns.
+func hardLink(keep, dup string) error {
+	return replaceAtomically(dup, func(tmp string) error { return os.Link(keep, tmp) })
+}
+
+// reflink is not supported on this platform.
+func reflink(_, _ string) error {
+	return errs.Newf("linker: reflinks are not supported on this platform")
+}
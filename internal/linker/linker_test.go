@@ -0,0 +1,120 @@
+package linker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/richardwilkes/toolbox/v2/check"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sameFile(t *testing.T, a, b string) bool {
+	t.Helper()
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+func TestReplaceRejectsUnknownMode(t *testing.T) {
+	c := check.New(t)
+	c.HasError(Replace(Mode("bogus"), "keep", "dup"))
+}
+
+func TestHardLinkReplacesDupWithLinkToKeep(t *testing.T) {
+	c := check.New(t)
+	dir := t.TempDir()
+	keep := filepath.Join(dir, "keep")
+	dup := filepath.Join(dir, "dup")
+	writeFile(t, keep, "content")
+	writeFile(t, dup, "content")
+
+	c.NoError(Replace(Hard, keep, dup))
+	c.True(sameFile(t, keep, dup))
+
+	content, err := os.ReadFile(dup)
+	c.NoError(err)
+	c.Equal("content", string(content))
+}
+
+func TestOnSameDeviceReportsTrueWithinOneFilesystem(t *testing.T) {
+	c := check.New(t)
+	dir := t.TempDir()
+	keep := filepath.Join(dir, "keep")
+	dup := filepath.Join(dir, "dup")
+	writeFile(t, keep, "content")
+	writeFile(t, dup, "content")
+
+	same, err := onSameDevice(keep, dup)
+	c.NoError(err)
+	c.True(same)
+}
+
+func TestOnSameDeviceErrorsForMissingFile(t *testing.T) {
+	c := check.New(t)
+	dir := t.TempDir()
+	_, err := onSameDevice(filepath.Join(dir, "missing"), filepath.Join(dir, "also-missing"))
+	c.HasError(err)
+}
+
+func TestReplaceAtomicallyLeavesNoTempFileOnSuccess(t *testing.T) {
+	c := check.New(t)
+	dir := t.TempDir()
+	dup := filepath.Join(dir, "dup")
+	writeFile(t, dup, "old")
+
+	c.NoError(replaceAtomically(dup, func(tmp string) error { return os.WriteFile(tmp, []byte("new"), 0o644) }))
+
+	content, err := os.ReadFile(dup)
+	c.NoError(err)
+	c.Equal("new", string(content))
+	_, err = os.Stat(dup + ".fdup-tmp")
+	c.True(os.IsNotExist(err))
+}
+
+func TestReplaceAtomicallyLeavesDupUntouchedWhenCreateFails(t *testing.T) {
+	c := check.New(t)
+	dir := t.TempDir()
+	dup := filepath.Join(dir, "dup")
+	writeFile(t, dup, "old")
+
+	c.HasError(replaceAtomically(dup, func(string) error { return os.ErrInvalid }))
+
+	content, err := os.ReadFile(dup)
+	c.NoError(err)
+	c.Equal("old", string(content))
+	_, err = os.Stat(dup + ".fdup-tmp")
+	c.True(os.IsNotExist(err))
+}
+
+// TestReflinkReportsErrorWhenUnsupported exercises the FICLONE path on whatever filesystem the test runs on. Most
+// CI and sandbox filesystems (ext4, tmpfs, 9p, ...) don't support reflinks, so replaceAtomically's failure-cleanup
+// path is what's actually being verified here: a failed reflink must leave dup untouched rather than truncated.
+func TestReflinkReportsErrorWhenUnsupported(t *testing.T) {
+	c := check.New(t)
+	dir := t.TempDir()
+	keep := filepath.Join(dir, "keep")
+	dup := filepath.Join(dir, "dup")
+	writeFile(t, keep, "keep-content")
+	writeFile(t, dup, "dup-content")
+
+	err := reflink(keep, dup)
+	if err == nil {
+		t.Skip("filesystem supports reflinks; nothing to exercise here")
+	}
+	content, readErr := os.ReadFile(dup)
+	c.NoError(readErr)
+	c.Equal("dup-content", string(content))
+}
@@ -1,19 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/dustin/go-humanize"
+	"github.com/richardwilkes/fdup/internal/linker"
 	"github.com/richardwilkes/toolbox/v2/i18n"
 	"github.com/richardwilkes/toolbox/v2/xflag"
 	"github.com/richardwilkes/toolbox/v2/xio"
@@ -23,21 +26,40 @@ import (
 	"github.com/yookoala/realpath"
 )
 
+// compareBufferSize is the chunk size used when streaming two files against each other for a byte-wise comparison.
+const compareBufferSize = 256 * 1024
+
+// bucketKey groups candidate files that could possibly be duplicates of one another. Files that don't share a size
+// can never be duplicates, so that's the only thing used to partition candidates; extension is a user-requested
+// filter (-ext), not a signal that two files of the same size can't be identical, so it must not split a size class.
+type bucketKey struct {
+	size int64
+}
+
+// fileGroup is a set of two or more files that were confirmed to have identical content.
+type fileGroup struct {
+	paths []string
+}
+
 var (
 	extensions             []string
 	hidden                 bool
 	remove                 bool
 	removeOnlyFromLast     bool
 	caseSensitive          bool
+	jobs                   int
+	dirsMode               bool
+	noCache                bool
+	rehash                 bool
+	cache                  *hashCache
+	linkMode               linker.Mode
+	reporter               Reporter
 	filesProcessed         int32
 	filesUnableToProcess   int32
 	bytesProcessed         int64
 	duplicatesFound        int32
 	duplicateBytes         int64
-	lock                   sync.Mutex
-	hashes                 = make(map[[32]byte][]string)
-	removed                []string
-	unableToRemove         []string
+	buckets                = make(map[bucketKey][]string)
 	removeOnlyFromLastRoot string
 )
 
@@ -56,11 +78,47 @@ func main() {
 		i18n.Text("Delete all duplicates found. The first copy encountered will be preserved"))
 	flag.BoolVar(&removeOnlyFromLast, "last", false,
 		i18n.Text("When deleting duplicates, only delete those found within the last directory tree specified on the command line"))
+	link := flag.String("link", "",
+		i18n.Text("Instead of deleting duplicates, replace them with a link to the retained copy. "+
+			"`mode` must be 'hard' or 'reflink'. Requires -delete"))
 	flag.BoolVar(&caseSensitive, "case", false, i18n.Text("Extensions are case-sensitive"))
+	flag.IntVar(&jobs, "jobs", runtime.NumCPU(),
+		i18n.Text("The number of files to hash simultaneously"))
+	flag.BoolVar(&dirsMode, "dirs", false,
+		i18n.Text("Look for duplicate directory subtrees instead of duplicate files"))
+	cachePath := flag.String("cache", defaultCachePath(),
+		i18n.Text("The `file` to use for caching previously computed file hashes"))
+	flag.BoolVar(&noCache, "no-cache", false, i18n.Text("Disable the hash cache"))
+	flag.BoolVar(&rehash, "rehash", false, i18n.Text("Ignore any cached hashes and recompute them"))
+	format := flag.String("format", string(FormatText),
+		i18n.Text("Report `format` to use. Must be 'text', 'json', 'ndjson', or 'csv'"))
 	xflag.AddVersionFlags()
 	xflag.Parse()
 	paths := flag.Args()
 
+	switch Format(*format) {
+	case FormatText, FormatJSON, FormatNDJSON, FormatCSV:
+	default:
+		xos.ExitWithMsg(fmt.Sprintf(i18n.Text("-format must be 'text', 'json', 'ndjson', or 'csv', not '%s'."), *format))
+	}
+	if remove && (Format(*format) == FormatNDJSON || Format(*format) == FormatCSV) {
+		xos.ExitWithMsg(fmt.Sprintf(
+			i18n.Text("-format=%s has no way to represent what -delete does; use -format=json or -format=text instead."),
+			*format))
+	}
+
+	if *link != "" {
+		if !remove {
+			xos.ExitWithMsg(i18n.Text("-link requires -delete."))
+		}
+		switch linker.Mode(*link) {
+		case linker.Hard, linker.Reflink:
+			linkMode = linker.Mode(*link)
+		default:
+			xos.ExitWithMsg(fmt.Sprintf(i18n.Text("-link must be 'hard' or 'reflink', not '%s'."), *link))
+		}
+	}
+
 	// If no paths specified, use the current directory
 	if len(paths) == 0 {
 		wd, err := os.Getwd()
@@ -100,15 +158,10 @@ func main() {
 	}
 
 	// Setup progress monitoring
-	w := xterm.NewAnsiWriter(os.Stdout)
-	w.Clear()
-	w.HideCursor()
-	xos.RunAtExit(func() {
-		w.ShowCursor()
-	})
-	status(w)
+	reporter = newReporter(Format(*format))
+	reporter.Progress()
 	done := make(chan chan bool)
-	go progress(w, done)
+	go progress(reporter, done)
 
 	// Ensure extensions are properly formatted
 	var ext []string
@@ -129,7 +182,21 @@ func main() {
 	}
 	extensions = ext
 
-	// Process the paths
+	// Open the hash cache, if enabled, so repeat runs over the same tree can skip re-hashing unchanged files.
+	if !noCache {
+		var err error
+		if cache, err = openCache(*cachePath, rehash); err != nil {
+			xos.ExitWithMsg(fmt.Sprintf(i18n.Text("Unable to open hash cache '%s': %s"), *cachePath, err))
+		}
+		xos.RunAtExit(func() {
+			if cache != nil {
+				xos.ExitIfErr(cache.close())
+			}
+		})
+	}
+
+	// Pass 1: walk the paths and bucket candidates by (size, extension). This is cheap and lets pass 2 skip any file
+	// that can't possibly have a duplicate.
 	type po struct {
 		path  string
 		order int
@@ -139,44 +206,43 @@ func main() {
 		list = append(list, po{path: path, order: order})
 	}
 	sort.Slice(list, func(i, j int) bool { return list[i].order < list[j].order })
+
+	if dirsMode {
+		roots := make([]string, len(list))
+		for i, one := range list {
+			roots[i] = one.path
+		}
+		for _, root := range roots {
+			xos.ExitIfErr(digestDirTree(root))
+		}
+		waitDone := make(chan bool)
+		done <- waitDone
+		<-waitDone
+		reportDirs(reporter)
+		reporter.Finish()
+		return
+	}
+
 	for _, one := range list {
 		xos.ExitIfErr(filepath.Walk(one.path, walker))
 	}
+
+	// Pass 2: dispatch each bucket with 2 or more candidates to a fixed pool of workers for comparison.
+	queue := xos.NewTaskQueue(&xos.TaskQueueConfig{Workers: jobs})
+	for _, candidates := range buckets {
+		if len(candidates) > 1 {
+			candidates := candidates
+			queue.Submit(func() { processBucket(candidates) })
+		}
+	}
+	queue.Shutdown()
+
 	waitDone := make(chan bool)
 	done <- waitDone
 	<-waitDone
 
 	// Report
-	status(w)
-	w.WriteByte('\n')
-	if remove {
-		summarizeList(w, i18n.Text("Removed"), removed)
-		summarizeList(w, i18n.Text("Unable to remove"), unableToRemove)
-	} else {
-		var dups []string
-		m := make(map[string][]string)
-		for _, v := range hashes {
-			if len(v) > 1 {
-				dups = append(dups, v[0])
-				m[v[0]] = v[1:]
-			}
-		}
-		if len(dups) > 0 {
-			for _, dup := range dups {
-				w.WriteByte('\n')
-				w.WriteString(dup)
-				w.WriteByte('\n')
-				for _, one := range m[dup] {
-					w.WriteString(one)
-					w.WriteByte('\n')
-				}
-			}
-		} else {
-			w.WriteByte('\n')
-			w.WriteString(i18n.Text("No duplicates found."))
-			w.WriteByte('\n')
-		}
-	}
+	reporter.Finish()
 }
 
 func rel(base, target string) string {
@@ -185,15 +251,14 @@ func rel(base, target string) string {
 	return path
 }
 
-func progress(w *xterm.AnsiWriter, done chan chan bool) {
+func progress(r Reporter, done chan chan bool) {
 	for {
 		select {
 		case response := <-done:
-			w.ShowCursor()
 			response <- true
 			return
 		case <-time.After(time.Second / 4):
-			status(w)
+			r.Progress()
 		}
 	}
 }
@@ -280,9 +345,9 @@ func walker(path string, info os.FileInfo, _ error) error {
 		return nil
 	}
 
-	// If this is a file, process it
+	// If this is a file, index it for later comparison
 	if !info.IsDir() && isFileNameAcceptable(name) {
-		processFile(path)
+		indexFile(path, info.Size())
 	}
 	return nil
 }
@@ -302,55 +367,197 @@ func isFileNameAcceptable(name string) bool {
 	return false
 }
 
-func processFile(path string) {
-	// Compute the SHA-256 hash of the file contents
-	f, err := os.Open(path)
+// indexFile records a candidate file's bucket membership. It is only ever called from the single-threaded walk, so
+// no locking is required here.
+func indexFile(path string, size int64) {
+	key := bucketKey{size: size}
+	buckets[key] = append(buckets[key], path)
+}
+
+// processBucket compares the candidates within a single bucket, which all share the same size. A bucket of exactly
+// two candidates is handled by processPair. Larger buckets are hashed so that candidates can be grouped without an
+// O(n^2) comparison.
+func processBucket(candidates []string) {
+	if len(candidates) == 2 {
+		processPair(candidates[0], candidates[1])
+		return
+	}
+
+	bySum := make(map[[32]byte][]string)
+	for _, path := range candidates {
+		sum, n, err := hashFileCached(path)
+		if err != nil {
+			atomic.AddInt32(&filesUnableToProcess, 1)
+			continue
+		}
+		atomic.AddInt32(&filesProcessed, 1)
+		atomic.AddInt64(&bytesProcessed, n)
+		bySum[sum] = append(bySum[sum], path)
+	}
+	for sum, paths := range bySum {
+		if len(paths) > 1 {
+			info, err := os.Stat(paths[0])
+			size := int64(0)
+			if err == nil {
+				size = info.Size()
+			}
+			recordGroup(paths, size, &sum)
+		}
+	}
+}
+
+// processPair compares the two candidates in a bucket of exactly two. Without a hash cache, a streaming byte-wise
+// compare is cheaper than hashing both files, so that's used. With a cache, hashFileCached is used instead: it
+// consults the cache before reading either file, so a repeat run over an unchanged tree resolves the pair from the
+// cache alone, and a cold run populates the cache for next time instead of leaving it for the >2-candidate path only.
+func processPair(path1, path2 string) {
+	if cache == nil {
+		equal, n, err := filesEqual(path1, path2)
+		if err != nil {
+			atomic.AddInt32(&filesUnableToProcess, 1)
+			return
+		}
+		atomic.AddInt32(&filesProcessed, 2)
+		atomic.AddInt64(&bytesProcessed, 2*n)
+		if equal {
+			recordGroup([]string{path1, path2}, n, nil)
+		}
+		return
+	}
+
+	sum1, n1, err := hashFileCached(path1)
 	if err != nil {
 		atomic.AddInt32(&filesUnableToProcess, 1)
 		return
 	}
-	defer xio.CloseIgnoringErrors(f)
-	h := sha256.New()
-	n, err := io.Copy(h, f)
+	atomic.AddInt32(&filesProcessed, 1)
+	atomic.AddInt64(&bytesProcessed, n1)
+
+	sum2, n2, err := hashFileCached(path2)
 	if err != nil {
 		atomic.AddInt32(&filesUnableToProcess, 1)
 		return
 	}
 	atomic.AddInt32(&filesProcessed, 1)
-	atomic.AddInt64(&bytesProcessed, n)
-	var sum [32]byte
-	copy(sum[:], h.Sum(nil))
+	atomic.AddInt64(&bytesProcessed, n2)
+
+	if sum1 == sum2 {
+		recordGroup([]string{path1, path2}, n1, &sum1)
+	}
+}
+
+// recordGroup reports a confirmed group of duplicate files and processes removal, if requested. sum is nil if the
+// group was confirmed by a byte-wise comparison rather than hashing.
+func recordGroup(paths []string, size int64, sum *[32]byte) {
+	atomic.AddInt32(&duplicatesFound, int32(len(paths)-1))
+	atomic.AddInt64(&duplicateBytes, size*int64(len(paths)-1))
 
-	// Add the info into our state
-	needRemove := false
-	lock.Lock()
-	paths, exists := hashes[sum]
-	if exists {
-		atomic.AddInt32(&duplicatesFound, 1)
-		atomic.AddInt64(&duplicateBytes, n)
-		if remove {
-			needRemove = true
-		} else {
-			hashes[sum] = append(paths, path)
+	if remove {
+		keep := paths[0]
+		for _, path := range paths[1:] {
+			if removeOnlyFromLast && strings.HasPrefix(rel(removeOnlyFromLastRoot, path), "..") {
+				continue
+			}
+			dedupFile(keep, path)
 		}
-	} else {
-		hashes[sum] = []string{path}
+		return
 	}
-	lock.Unlock()
 
-	// Process any removal
-	if needRemove {
-		if removeOnlyFromLast && strings.HasPrefix(rel(removeOnlyFromLastRoot, path), "..") {
+	reporter.Group(paths, size, sum)
+}
+
+// dedupFile removes path, or replaces it with a link to keep, depending on the -link mode in effect.
+func dedupFile(keep, path string) {
+	var err error
+	if linkMode != "" {
+		if err = linker.Replace(linkMode, keep, path); err == nil {
+			reporter.Linked(path)
 			return
 		}
-		if err = os.Remove(path); err != nil {
-			lock.Lock()
-			unableToRemove = append(unableToRemove, path)
-			lock.Unlock()
-		} else {
-			lock.Lock()
-			removed = append(removed, path)
-			lock.Unlock()
+	} else {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		reporter.UnableToDedup(path)
+		return
+	}
+	reporter.Removed(path)
+}
+
+// hashFileCached consults the hash cache before hashing path, and writes the result back to it after a successful
+// hash. If the cache is disabled, or the platform can't identify the file well enough to key the cache, this falls
+// back to always hashing.
+func hashFileCached(path string) (sum [32]byte, n int64, err error) {
+	if cache == nil {
+		return hashFile(path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return sum, 0, err
+	}
+	key, ok := cacheKeyFor(info)
+	if !ok {
+		return hashFile(path)
+	}
+	if cached, found := cache.lookup(key); found {
+		return cached, info.Size(), nil
+	}
+	if sum, n, err = hashFile(path); err != nil {
+		return sum, n, err
+	}
+	cache.store(key, sum)
+	return sum, n, nil
+}
+
+// hashFile computes the SHA-256 hash of the file at path, returning the hash and the number of bytes read.
+func hashFile(path string) (sum [32]byte, n int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, 0, err
+	}
+	defer xio.CloseIgnoringErrors(f)
+	h := sha256.New()
+	if n, err = io.Copy(h, f); err != nil {
+		return sum, n, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, n, nil
+}
+
+// filesEqual streams both files in lock-step, comparing their contents without hashing either one. It returns the
+// number of bytes compared from each file before the comparison concluded.
+func filesEqual(path1, path2 string) (equal bool, n int64, err error) {
+	f1, err := os.Open(path1)
+	if err != nil {
+		return false, 0, err
+	}
+	defer xio.CloseIgnoringErrors(f1)
+	f2, err := os.Open(path2)
+	if err != nil {
+		return false, 0, err
+	}
+	defer xio.CloseIgnoringErrors(f2)
+
+	r1 := bufio.NewReaderSize(f1, compareBufferSize)
+	r2 := bufio.NewReaderSize(f2, compareBufferSize)
+	buf1 := make([]byte, compareBufferSize)
+	buf2 := make([]byte, compareBufferSize)
+	for {
+		read1, err1 := io.ReadFull(r1, buf1)
+		read2, err2 := io.ReadFull(r2, buf2)
+		n += int64(read1)
+		if err1 != nil && err1 != io.ErrUnexpectedEOF && err1 != io.EOF {
+			return false, n, err1
+		}
+		if err2 != nil && err2 != io.ErrUnexpectedEOF && err2 != io.EOF {
+			return false, n, err2
+		}
+		if read1 != read2 || !bytes.Equal(buf1[:read1], buf2[:read2]) {
+			return false, n, nil
+		}
+		if err1 != nil {
+			// Both readers reached EOF at the same offset with identical content.
+			return true, n, nil
 		}
 	}
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/richardwilkes/toolbox/v2/check"
+)
+
+func writeTempFile(t *testing.T, dir, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFilesEqualComparesContent(t *testing.T) {
+	c := check.New(t)
+	dir := t.TempDir()
+	a := writeTempFile(t, dir, "a", []byte("same content"))
+	b := writeTempFile(t, dir, "b", []byte("same content"))
+	d := writeTempFile(t, dir, "d", []byte("different content!"))
+
+	equal, n, err := filesEqual(a, b)
+	c.NoError(err)
+	c.True(equal)
+	c.Equal(int64(len("same content")), n)
+
+	equal, _, err = filesEqual(a, d)
+	c.NoError(err)
+	c.False(equal)
+}
+
+// TestIndexFileBucketsBySizeOnly guards against bucketKey reintroducing an extension component: two files of the
+// same size but different extensions must land in the same bucket so byte-identical cross-extension files are still
+// detected as duplicates.
+func TestIndexFileBucketsBySizeOnly(t *testing.T) {
+	c := check.New(t)
+	orig := buckets
+	defer func() { buckets = orig }()
+	buckets = make(map[bucketKey][]string)
+
+	indexFile("/a.jpg", 4)
+	indexFile("/b.jpeg", 4)
+	indexFile("/c.jpg", 5)
+
+	c.Equal(2, len(buckets[bucketKey{size: 4}]))
+	c.Equal(1, len(buckets[bucketKey{size: 5}]))
+}
+
+// withCounters resets the package-level atomics processPair/processBucket/recordGroup update, running fn, then
+// restoring their original values so tests don't bleed state into one another.
+func withCounters(fn func()) {
+	origProcessed, origUnable := atomic.LoadInt32(&filesProcessed), atomic.LoadInt32(&filesUnableToProcess)
+	origBytes := atomic.LoadInt64(&bytesProcessed)
+	origFound, origDupeBytes := atomic.LoadInt32(&duplicatesFound), atomic.LoadInt64(&duplicateBytes)
+	atomic.StoreInt32(&filesProcessed, 0)
+	atomic.StoreInt32(&filesUnableToProcess, 0)
+	atomic.StoreInt64(&bytesProcessed, 0)
+	atomic.StoreInt32(&duplicatesFound, 0)
+	atomic.StoreInt64(&duplicateBytes, 0)
+	defer func() {
+		atomic.StoreInt32(&filesProcessed, origProcessed)
+		atomic.StoreInt32(&filesUnableToProcess, origUnable)
+		atomic.StoreInt64(&bytesProcessed, origBytes)
+		atomic.StoreInt32(&duplicatesFound, origFound)
+		atomic.StoreInt64(&duplicateBytes, origDupeBytes)
+	}()
+	fn()
+}
+
+func TestProcessPairWithoutCacheUsesByteCompare(t *testing.T) {
+	c := check.New(t)
+	origCache, origRemove, origReporter := cache, remove, reporter
+	defer func() { cache, remove, reporter = origCache, origRemove, origReporter }()
+	cache, remove = nil, false
+	r := &recordingReporter{}
+	reporter = r
+
+	dir := t.TempDir()
+	a := writeTempFile(t, dir, "a", []byte("duplicate"))
+	b := writeTempFile(t, dir, "b", []byte("duplicate"))
+
+	withCounters(func() {
+		processPair(a, b)
+		c.Equal(1, len(r.groups))
+		c.Equal(int32(2), atomic.LoadInt32(&filesProcessed))
+		c.Equal(int32(1), atomic.LoadInt32(&duplicatesFound))
+	})
+}
+
+func TestProcessPairWithCacheUsesHashComparison(t *testing.T) {
+	c := check.New(t)
+	origCache, origRemove, origReporter := cache, remove, reporter
+	defer func() { cache, remove, reporter = origCache, origRemove, origReporter }()
+	newCache, err := openCache(filepath.Join(t.TempDir(), "hashes.db"), false)
+	c.NoError(err)
+	defer func() { c.NoError(newCache.close()) }()
+	cache, remove = newCache, false
+	r := &recordingReporter{}
+	reporter = r
+
+	dir := t.TempDir()
+	a := writeTempFile(t, dir, "a", []byte("duplicate"))
+	b := writeTempFile(t, dir, "b", []byte("duplicate"))
+	different := writeTempFile(t, dir, "c", []byte("different"))
+
+	withCounters(func() {
+		processPair(a, b)
+		c.Equal(1, len(r.groups))
+	})
+	withCounters(func() {
+		processPair(a, different)
+		c.Equal(1, len(r.groups))
+	})
+}
+
+func TestProcessBucketGroupsCandidatesBySum(t *testing.T) {
+	c := check.New(t)
+	origCache, origRemove, origReporter := cache, remove, reporter
+	defer func() { cache, remove, reporter = origCache, origRemove, origReporter }()
+	cache, remove = nil, false
+	r := &recordingReporter{}
+	reporter = r
+
+	dir := t.TempDir()
+	a := writeTempFile(t, dir, "a", []byte("match"))
+	b := writeTempFile(t, dir, "b", []byte("match"))
+	d := writeTempFile(t, dir, "d", []byte("other"))
+
+	withCounters(func() {
+		processBucket([]string{a, b, d})
+		c.Equal(1, len(r.groups))
+		c.Equal(int32(3), atomic.LoadInt32(&filesProcessed))
+		c.Equal(int32(1), atomic.LoadInt32(&duplicatesFound))
+	})
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dustin/go-humanize"
+	"github.com/richardwilkes/toolbox/v2/i18n"
+	"github.com/richardwilkes/toolbox/v2/xos"
+	"github.com/richardwilkes/toolbox/v2/xterm"
+)
+
+// Format selects how the results of a run are reported.
+type Format string
+
+// The supported report formats.
+const (
+	// FormatText is the default human-readable report, rendered live with ANSI escape sequences.
+	FormatText Format = "text"
+	// FormatJSON emits a single JSON document once processing has completed.
+	FormatJSON Format = "json"
+	// FormatNDJSON streams one JSON object per duplicate group as it is discovered, rather than waiting for the run
+	// to finish.
+	FormatNDJSON Format = "ndjson"
+	// FormatCSV streams one row per file as duplicate groups are discovered.
+	FormatCSV Format = "csv"
+)
+
+// Reporter receives progress updates and results as they're discovered and renders them in whatever shape the
+// selected Format calls for. Adding a new format only requires a new implementation of this interface.
+type Reporter interface {
+	// Progress is invoked periodically (and once immediately) while files are being scanned.
+	Progress()
+	// Group records a confirmed duplicate group. sum is nil if the group was confirmed by a byte-wise comparison
+	// rather than hashing; see hashFor.
+	Group(paths []string, size int64, sum *[32]byte)
+	// Removed records a duplicate that was deleted.
+	Removed(path string)
+	// Linked records a duplicate that was replaced with a link to the file it duplicates.
+	Linked(path string)
+	// UnableToDedup records a duplicate that could not be removed or linked.
+	UnableToDedup(path string)
+	// Finish is called once, after all processing has completed, to flush any buffered output and print a summary.
+	Finish()
+}
+
+// newReporter creates the Reporter for the given format.
+func newReporter(format Format) Reporter {
+	switch format {
+	case FormatJSON:
+		return newJSONReporter()
+	case FormatNDJSON:
+		return newNDJSONReporter()
+	case FormatCSV:
+		return newCSVReporter()
+	default:
+		return newTextReporter()
+	}
+}
+
+// hashFor returns sum as a hex string, or "" if sum is nil. sum is nil when a two-candidate group was confirmed by a
+// byte-wise streaming compare rather than a hash (see processPair), which only happens when the hash cache is
+// disabled; hashing paths[0] here just to fill in this field would quietly reintroduce the extra read that streaming
+// compare was chosen to avoid, so such groups report an empty hash instead.
+func hashFor(sum *[32]byte) string {
+	if sum == nil {
+		return ""
+	}
+	return hex.EncodeToString(sum[:])
+}
+
+// plainProgressLine renders the same counts status() shows, without any ANSI styling, for use on a non-interactive
+// report format's stderr progress line.
+func plainProgressLine() string {
+	count := atomic.LoadInt32(&filesProcessed)
+	bytesCount := atomic.LoadInt64(&bytesProcessed)
+	dupes := atomic.LoadInt32(&duplicatesFound)
+	dupeBytes := atomic.LoadInt64(&duplicateBytes)
+	return fmt.Sprintf(i18n.Text("Examined %s files containing %s bytes. Found %s duplicate files containing %s bytes."),
+		humanize.Comma(int64(count)), humanize.Comma(bytesCount), humanize.Comma(int64(dupes)), humanize.Comma(dupeBytes))
+}
+
+// writeStderrProgress overwrites the current line on stderr with the current counts, but only if stderr is a
+// terminal. It is used by the structured reporters, which reserve stdout for their output and must not mix the
+// human-readable ANSI progress writer into it.
+func writeStderrProgress() {
+	if xterm.IsTerminal(os.Stderr) {
+		fmt.Fprintf(os.Stderr, "\r\033[K%s", plainProgressLine())
+	}
+}
+
+// endStderrProgress terminates the in-place progress line started by writeStderrProgress, if one was ever started.
+func endStderrProgress() {
+	if xterm.IsTerminal(os.Stderr) {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// textReporter renders the classic human-readable report, live on stdout via ANSI escape sequences.
+type textReporter struct {
+	w       *xterm.AnsiWriter
+	lock    sync.Mutex
+	groups  []*fileGroup
+	removed []string
+	linked  []string
+	unable  []string
+}
+
+func newTextReporter() *textReporter {
+	w := xterm.NewAnsiWriter(os.Stdout)
+	w.Clear()
+	w.HideCursor()
+	xos.RunAtExit(func() {
+		w.ShowCursor()
+	})
+	return &textReporter{w: w}
+}
+
+func (r *textReporter) Progress() {
+	status(r.w)
+}
+
+func (r *textReporter) Group(paths []string, _ int64, _ *[32]byte) {
+	r.lock.Lock()
+	r.groups = append(r.groups, &fileGroup{paths: paths})
+	r.lock.Unlock()
+}
+
+func (r *textReporter) Removed(path string) {
+	r.lock.Lock()
+	r.removed = append(r.removed, path)
+	r.lock.Unlock()
+}
+
+func (r *textReporter) Linked(path string) {
+	r.lock.Lock()
+	r.linked = append(r.linked, path)
+	r.lock.Unlock()
+}
+
+func (r *textReporter) UnableToDedup(path string) {
+	r.lock.Lock()
+	r.unable = append(r.unable, path)
+	r.lock.Unlock()
+}
+
+func (r *textReporter) Finish() {
+	r.w.ShowCursor()
+	status(r.w)
+	r.w.WriteByte('\n')
+	if remove {
+		summarizeList(r.w, i18n.Text("Removed"), r.removed)
+		summarizeList(r.w, i18n.Text("Linked"), r.linked)
+		summarizeList(r.w, i18n.Text("Unable to dedup"), r.unable)
+		return
+	}
+	if len(r.groups) > 0 {
+		for _, group := range r.groups {
+			r.w.WriteByte('\n')
+			for _, one := range group.paths {
+				r.w.WriteString(one)
+				r.w.WriteByte('\n')
+			}
+		}
+		return
+	}
+	r.w.WriteByte('\n')
+	if dirsMode {
+		r.w.WriteString(i18n.Text("No duplicate directories found."))
+	} else {
+		r.w.WriteString(i18n.Text("No duplicates found."))
+	}
+	r.w.WriteByte('\n')
+}
+
+// jsonGroup is the on-the-wire shape of a single duplicate group in -format=json and -format=ndjson.
+type jsonGroup struct {
+	Hash  string   `json:"hash"`
+	Size  int64    `json:"size"`
+	Paths []string `json:"paths"`
+}
+
+// jsonSummary is the on-the-wire shape of the run totals in -format=json.
+type jsonSummary struct {
+	FilesExamined   int64 `json:"files_examined"`
+	BytesExamined   int64 `json:"bytes_examined"`
+	DuplicatesFound int64 `json:"duplicates_found"`
+	DuplicateBytes  int64 `json:"duplicate_bytes"`
+	Removed         int   `json:"removed,omitempty"`
+	Linked          int   `json:"linked,omitempty"`
+	UnableToDedup   int   `json:"unable_to_dedup,omitempty"`
+}
+
+// jsonDoc is the single document written to stdout by jsonReporter.
+type jsonDoc struct {
+	Groups        []jsonGroup `json:"groups,omitempty"`
+	Removed       []string    `json:"removed,omitempty"`
+	Linked        []string    `json:"linked,omitempty"`
+	UnableToDedup []string    `json:"unable_to_dedup,omitempty"`
+	Summary       jsonSummary `json:"summary"`
+}
+
+// jsonReporter buffers the whole run in memory and writes it out as a single JSON document in Finish, since the
+// summary it includes isn't known until the run completes.
+type jsonReporter struct {
+	lock sync.Mutex
+	doc  jsonDoc
+}
+
+func newJSONReporter() *jsonReporter {
+	return &jsonReporter{}
+}
+
+func (r *jsonReporter) Progress() {
+	writeStderrProgress()
+}
+
+func (r *jsonReporter) Group(paths []string, size int64, sum *[32]byte) {
+	group := jsonGroup{Hash: hashFor(sum), Size: size, Paths: append([]string(nil), paths...)}
+	r.lock.Lock()
+	r.doc.Groups = append(r.doc.Groups, group)
+	r.lock.Unlock()
+}
+
+func (r *jsonReporter) Removed(path string) {
+	r.lock.Lock()
+	r.doc.Removed = append(r.doc.Removed, path)
+	r.lock.Unlock()
+}
+
+func (r *jsonReporter) Linked(path string) {
+	r.lock.Lock()
+	r.doc.Linked = append(r.doc.Linked, path)
+	r.lock.Unlock()
+}
+
+func (r *jsonReporter) UnableToDedup(path string) {
+	r.lock.Lock()
+	r.doc.UnableToDedup = append(r.doc.UnableToDedup, path)
+	r.lock.Unlock()
+}
+
+func (r *jsonReporter) Finish() {
+	endStderrProgress()
+	r.doc.Summary = jsonSummary{
+		FilesExamined:   int64(atomic.LoadInt32(&filesProcessed)),
+		BytesExamined:   atomic.LoadInt64(&bytesProcessed),
+		DuplicatesFound: int64(atomic.LoadInt32(&duplicatesFound)),
+		DuplicateBytes:  atomic.LoadInt64(&duplicateBytes),
+		Removed:         len(r.doc.Removed),
+		Linked:          len(r.doc.Linked),
+		UnableToDedup:   len(r.doc.UnableToDedup),
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	xos.ExitIfErr(enc.Encode(r.doc))
+}
+
+// ndjsonReporter streams one JSON object per duplicate group to stdout as each is discovered, rather than buffering
+// the whole run like jsonReporter does. It has no documented shape for -delete mode's removed/linked/unable-to-dedup
+// events, so main refuses to combine -delete with -format=ndjson; Removed/Linked/UnableToDedup are no-ops purely to
+// satisfy the Reporter interface and should never be reached.
+type ndjsonReporter struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+func newNDJSONReporter() *ndjsonReporter {
+	return &ndjsonReporter{enc: json.NewEncoder(os.Stdout)}
+}
+
+func (r *ndjsonReporter) Progress() {
+	writeStderrProgress()
+}
+
+func (r *ndjsonReporter) Group(paths []string, size int64, sum *[32]byte) {
+	group := jsonGroup{Hash: hashFor(sum), Size: size, Paths: paths}
+	r.lock.Lock()
+	xos.ExitIfErr(r.enc.Encode(group))
+	r.lock.Unlock()
+}
+
+func (r *ndjsonReporter) Removed(string) {}
+
+func (r *ndjsonReporter) Linked(string) {}
+
+func (r *ndjsonReporter) UnableToDedup(string) {}
+
+func (r *ndjsonReporter) Finish() {
+	endStderrProgress()
+}
+
+// csvReporter streams one row per file to stdout as each duplicate group is discovered. Like ndjsonReporter, it has
+// no documented row shape for -delete mode's results, so main refuses to combine -delete with -format=csv;
+// Removed/Linked/UnableToDedup are no-ops purely to satisfy the Reporter interface and should never be reached.
+type csvReporter struct {
+	lock sync.Mutex
+	w    *csv.Writer
+}
+
+func newCSVReporter() *csvReporter {
+	r := &csvReporter{w: csv.NewWriter(os.Stdout)}
+	xos.ExitIfErr(r.w.Write([]string{"hash", "size", "path", "is_primary"}))
+	r.w.Flush()
+	return r
+}
+
+func (r *csvReporter) Progress() {
+	writeStderrProgress()
+}
+
+func (r *csvReporter) Group(paths []string, size int64, sum *[32]byte) {
+	hash := hashFor(sum)
+	sizeStr := fmt.Sprintf("%d", size)
+	r.lock.Lock()
+	for i, path := range paths {
+		xos.ExitIfErr(r.w.Write([]string{hash, sizeStr, path, fmt.Sprintf("%t", i == 0)}))
+	}
+	r.w.Flush()
+	xos.ExitIfErr(r.w.Error())
+	r.lock.Unlock()
+}
+
+func (r *csvReporter) Removed(string) {}
+
+func (r *csvReporter) Linked(string) {}
+
+func (r *csvReporter) UnableToDedup(string) {}
+
+func (r *csvReporter) Finish() {
+	endStderrProgress()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/richardwilkes/toolbox/v2/check"
+	"github.com/richardwilkes/toolbox/v2/xterm"
+)
+
+// captureStdout redirects os.Stdout to a pipe for the duration of fn and returns everything written to it. It's only
+// needed for the reporters whose Finish method writes to os.Stdout directly rather than through a field the test can
+// point at a buffer.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	orig := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	defer func() { os.Stdout = orig }()
+
+	fn()
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err = buf.ReadFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func withDupeCounters(found int32, bytesCount int64, fn func()) {
+	origFound, origBytes := atomic.LoadInt32(&duplicatesFound), atomic.LoadInt64(&duplicateBytes)
+	origProcessed, origProcBytes := atomic.LoadInt32(&filesProcessed), atomic.LoadInt64(&bytesProcessed)
+	atomic.StoreInt32(&duplicatesFound, found)
+	atomic.StoreInt64(&duplicateBytes, bytesCount)
+	defer func() {
+		atomic.StoreInt32(&duplicatesFound, origFound)
+		atomic.StoreInt64(&duplicateBytes, origBytes)
+		atomic.StoreInt32(&filesProcessed, origProcessed)
+		atomic.StoreInt64(&bytesProcessed, origProcBytes)
+	}()
+	fn()
+}
+
+func TestHashForFormatsOrEmptiesSum(t *testing.T) {
+	c := check.New(t)
+	c.Equal("", hashFor(nil))
+	sum := [32]byte{0xde, 0xad, 0xbe, 0xef}
+	want := "deadbeef" + strings.Repeat("00", 28)
+	c.Equal(want, hashFor(&sum))
+}
+
+func TestNewReporterSelectsByFormat(t *testing.T) {
+	c := check.New(t)
+	_, ok := newReporter(FormatJSON).(*jsonReporter)
+	c.True(ok)
+	_, ok = newReporter(FormatNDJSON).(*ndjsonReporter)
+	c.True(ok)
+
+	var csvOK, textOK, defaultOK bool
+	captureStdout(t, func() {
+		_, csvOK = newReporter(FormatCSV).(*csvReporter)
+		_, textOK = newReporter(FormatText).(*textReporter)
+		_, defaultOK = newReporter(Format("bogus")).(*textReporter)
+	})
+	c.True(csvOK)
+	c.True(textOK)
+	c.True(defaultOK)
+}
+
+func TestTextReporterFinishListsGroupsFound(t *testing.T) {
+	c := check.New(t)
+	var buf bytes.Buffer
+	r := &textReporter{w: xterm.NewAnsiWriter(&buf)}
+	r.Group([]string{"/a", "/b"}, 10, nil)
+
+	withDupeCounters(1, 10, func() { r.Finish() })
+
+	out := buf.String()
+	c.Contains(out, "/a")
+	c.Contains(out, "/b")
+}
+
+func TestTextReporterFinishReportsNoDuplicates(t *testing.T) {
+	c := check.New(t)
+	var buf bytes.Buffer
+	r := &textReporter{w: xterm.NewAnsiWriter(&buf)}
+
+	withDupeCounters(0, 0, func() { r.Finish() })
+
+	c.Contains(buf.String(), "No duplicates found.")
+}
+
+func TestTextReporterFinishSummarizesRemovals(t *testing.T) {
+	c := check.New(t)
+	origRemove := remove
+	remove = true
+	defer func() { remove = origRemove }()
+
+	var buf bytes.Buffer
+	r := &textReporter{w: xterm.NewAnsiWriter(&buf)}
+	r.Removed("/removed")
+	r.Linked("/linked")
+	r.UnableToDedup("/unable")
+
+	withDupeCounters(0, 0, func() { r.Finish() })
+
+	out := buf.String()
+	c.Contains(out, "/removed")
+	c.Contains(out, "/linked")
+	c.Contains(out, "/unable")
+}
+
+func TestJSONReporterFinishEmitsGroupsAndSummary(t *testing.T) {
+	c := check.New(t)
+	r := newJSONReporter()
+	sum := [32]byte{1, 2, 3}
+	r.Group([]string{"/a", "/b"}, 10, &sum)
+
+	out := captureStdout(t, func() {
+		withDupeCounters(1, 10, func() { r.Finish() })
+	})
+
+	var doc jsonDoc
+	c.NoError(json.Unmarshal([]byte(out), &doc))
+	c.Equal(1, len(doc.Groups))
+	c.Equal([]string{"/a", "/b"}, doc.Groups[0].Paths)
+	c.Equal(int64(1), doc.Summary.DuplicatesFound)
+	c.Equal(int64(10), doc.Summary.DuplicateBytes)
+}
+
+func TestNDJSONReporterStreamsOneObjectPerGroup(t *testing.T) {
+	c := check.New(t)
+	var buf bytes.Buffer
+	r := &ndjsonReporter{enc: json.NewEncoder(&buf)}
+	r.Group([]string{"/a", "/b"}, 10, nil)
+	r.Group([]string{"/c", "/d"}, 20, nil)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Equal(2, len(lines))
+	var g jsonGroup
+	c.NoError(json.Unmarshal([]byte(lines[1]), &g))
+	c.Equal([]string{"/c", "/d"}, g.Paths)
+	c.Equal(int64(20), g.Size)
+}
+
+func TestCSVReporterWritesOneRowPerFile(t *testing.T) {
+	c := check.New(t)
+	var buf bytes.Buffer
+	r := &csvReporter{w: csv.NewWriter(&buf)}
+	sum := [32]byte{0xaa}
+	r.Group([]string{"/a", "/b"}, 10, &sum)
+
+	rows, err := csv.NewReader(strings.NewReader(buf.String())).ReadAll()
+	c.NoError(err)
+	c.Equal(2, len(rows))
+	c.Equal("/a", rows[0][2])
+	c.Equal("true", rows[0][3])
+	c.Equal("/b", rows[1][2])
+	c.Equal("false", rows[1][3])
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statIdentity returns the device and inode numbers for info, if the underlying platform exposes them. On Linux this
+// comes from the *syscall.Stat_t embedded in os.FileInfo.Sys().
+func statIdentity(info os.FileInfo) (dev, ino uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Dev), st.Ino, true
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import "os"
+
+// statIdentity returns the device and inode numbers for info, if the underlying platform exposes them. There is no
+// portable way to get at this information, so platforms other than Linux and macOS report it as unavailable.
+func statIdentity(_ os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}